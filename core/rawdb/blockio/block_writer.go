@@ -4,6 +4,8 @@ import (
 	"context"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"sync/atomic"
 	"time"
 
 	"github.com/ledgerwatch/erigon-lib/kv/backup"
@@ -18,6 +20,7 @@ import (
 	"github.com/ledgerwatch/erigon-lib/kv"
 	"github.com/ledgerwatch/erigon-lib/kv/rawdbv3"
 	"github.com/ledgerwatch/erigon/core/rawdb"
+	"github.com/ledgerwatch/erigon/core/rawdb/freezer"
 	"github.com/ledgerwatch/erigon/polygon/bor/bordb"
 )
 
@@ -27,12 +30,30 @@ import (
 
 // BlockReader can read blocks from db and snapshots
 type BlockWriter struct {
+	// tombstones is an atomic snapshot of every live soft-prune range, read
+	// lock-free by IsPruned; see tombstone.go.
+	tombstones atomic.Pointer[tombstoneState]
 }
 
+// NewBlockWriter returns a BlockWriter with empty tombstone state. If the db
+// it will be used against may already hold tombstones from a previous
+// process run, call LoadTombstones once before relying on IsPruned.
 func NewBlockWriter() *BlockWriter {
-	return &BlockWriter{}
+	w := &BlockWriter{}
+	w.tombstones.Store(newTombstoneState())
+	return w
 }
 
+// FillHeaderNumberIndex stays on etl.Transform rather than
+// IterateCanonicalBlocks: etl externally sorts and bulk-loads kv.HeaderNumber
+// in one pass with no per-key random writes, which is the load pattern this
+// index needs over the potentially chain-long [from, to) range.
+// IterateCanonicalBlocks fetches a block's full column set (header, body,
+// senders, receipts, TD) per item and is built for bounded, per-block work
+// like freezing or RebuildIndexes - it has no bulk-load path and would turn
+// this into `to-from` individual kv.Headers reads plus random
+// kv.HeaderNumber writes for no benefit, since the only column this index
+// needs is already sitting in the kv.Headers key.
 func (w *BlockWriter) FillHeaderNumberIndex(logPrefix string, tx kv.RwTx, tmpDir string, from, to uint64, ctx context.Context, logger log.Logger) error {
 	startKey := make([]byte, 8)
 	binary.BigEndian.PutUint64(startKey, from)
@@ -55,6 +76,13 @@ func (w *BlockWriter) FillHeaderNumberIndex(logPrefix string, tx kv.RwTx, tmpDir
 	)
 }
 
+// MakeBodiesCanonical does not walk blocks via IterateCanonicalBlocks: it
+// has no per-block work to do in the first place. rawdb.AppendCanonicalTxNums
+// derives the whole [from, ...) tx-num mapping from kv.BlockBody's
+// BaseTxId/TxAmount fields in a single bulk pass of its own; wrapping that
+// one call in a per-block iterator would add the iterator's worker-pool and
+// channel overhead (plus unused Header/Senders/Receipts/TD fetches) around a
+// function that is already the bulk primitive this index needs.
 func (w *BlockWriter) MakeBodiesCanonical(tx kv.RwTx, from uint64) error {
 	if err := rawdb.AppendCanonicalTxNums(tx, from); err != nil {
 		var e1 rawdbv3.ErrTxNumsAppendWithGap
@@ -113,8 +141,35 @@ var (
 // keeps genesis in db
 // doesn't change sequences of kv.EthTx and kv.NonCanonicalTxs
 // doesn't delete Receipts, Senders, Canonical markers, TotalDifficulty
-func (w *BlockWriter) PruneBlocks(ctx context.Context, tx kv.RwTx, blockTo uint64, blocksDeleteLimit int) (deleted int, err error) {
+//
+// If frz is non-nil it is used as the migration target instead of assuming
+// the snapshot layer already holds [1, blockTo): blocks are streamed into
+// the freezer in canonical order (via IterateCanonicalBlocks) and fsynced
+// before anything is deleted from tx, so a crash mid-prune never loses
+// data. Readers below frz.Frozen() must fall through to the freezer
+// instead of the KV tables pruned here.
+//
+// mode selects between PruneModeHard (the original behavior: rows are
+// deleted immediately) and PruneModeSoft, which tombstones the range
+// instead and leaves the rows for a later CompactTombstones. Soft pruning
+// gives operators a reversible window via UnwindPrune.
+func (w *BlockWriter) PruneBlocks(ctx context.Context, db kv.RoDB, tx kv.RwTx, blockTo uint64, blocksDeleteLimit int, frz *freezer.Freezer, mode PruneMode) (deleted int, err error) {
 	defer mxPruneTookBlocks.ObserveDuration(time.Now())
+	if frz != nil {
+		if err := freezeBlocks(ctx, db, frz, blockTo, blocksDeleteLimit); err != nil {
+			return 0, fmt.Errorf("freeze blocks up to %d: %w", blockTo, err)
+		}
+		// freezeBlocks only advances the freezer by up to blocksDeleteLimit
+		// blocks per call, so it can leave frz.Frozen() short of blockTo.
+		// Never delete more from the KV than is durably frozen, or a crash
+		// between the two could lose a block's only copy.
+		if frz.Frozen() < blockTo {
+			blockTo = frz.Frozen()
+		}
+	}
+	if mode == PruneModeSoft {
+		return w.softPruneBlocks(tx, blockTo, blocksDeleteLimit)
+	}
 	return rawdb.PruneBlocks(tx, blockTo, blocksDeleteLimit)
 }
 
@@ -122,7 +177,17 @@ func (w *BlockWriter) PruneBlocks(ctx context.Context, tx kv.RwTx, blockTo uint6
 // keeps genesis in db
 // doesn't change sequences of kv.EthTx and kv.NonCanonicalTxs
 // doesn't delete Receipts, Senders, Canonical markers, TotalDifficulty
-func (w *BlockWriter) PruneBorBlocks(ctx context.Context, tx kv.RwTx, blockTo uint64, blocksDeleteLimit int, SpanIdAt func(number uint64) uint64) (deleted int, err error) {
+//
+// mode is accepted for symmetry with PruneBlocks, but bordb.PruneBorBlocks
+// has no tombstone-aware variant yet: PruneModeSoft returns an error rather
+// than silently hard-deleting bor data out from under a caller expecting a
+// reversible prune.
+func (w *BlockWriter) PruneBorBlocks(ctx context.Context, tx kv.RwTx, blockTo uint64, blocksDeleteLimit int, SpanIdAt func(number uint64) uint64, mode PruneMode) (deleted int, err error) {
 	defer mxPruneTookBor.ObserveDuration(time.Now())
+	if mode == PruneModeSoft {
+		return 0, fmt.Errorf("PruneBorBlocks: %w", errSoftPruneUnsupported)
+	}
 	return bordb.PruneBorBlocks(tx, blockTo, blocksDeleteLimit, SpanIdAt)
 }
+
+var errSoftPruneUnsupported = errors.New("soft prune mode is not implemented for this table set")
@@ -0,0 +1,240 @@
+package blockio
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/common/hexutility"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/dbutils"
+)
+
+// BlockEntry is one canonical block's columns, as handed to a ChainIterator
+// consumer. If fetching the block failed, Err is set, Number (and Hash, once
+// the canonical hash was read) identify the block, and the column fields are
+// nil; the entry is still the last one sent before the channel closes.
+type BlockEntry struct {
+	Number          uint64
+	Hash            common.Hash
+	Header          []byte // RLP
+	Body            []byte // RLP
+	Senders         []byte // concatenated 20-byte addresses, one per body tx
+	Receipts        []byte // RLP
+	TotalDifficulty []byte // big.Int RLP, as stored in kv.HeaderTD
+	Err             error
+}
+
+// IterateOpts configures IterateCanonicalBlocks.
+type IterateOpts struct {
+	// Workers is the number of goroutines fetching blocks concurrently.
+	// Defaults to 4.
+	Workers int
+	// Prefetch bounds how many blocks may be fetched ahead of the slowest
+	// consumer, i.e. the backpressure window. Defaults to 2*Workers.
+	Prefetch int
+	// Checkpoint, if non-empty, names this consumer: IterateCanonicalBlocks
+	// looks up LoadCheckpoint(consumer) before starting and, if it's past
+	// `from`, resumes there instead. Callers still need to persist progress
+	// themselves via SaveCheckpoint(tx, opts.Checkpoint, entry.Number+1) as
+	// they consume entries.
+	Checkpoint string
+}
+
+// IterateCanonicalBlocks drives a bounded worker pool that fetches headers,
+// bodies, senders, receipts and total difficulty for canonical blocks
+// [from, to) and emits them, in order, over the returned channel.
+//
+// If opts.Checkpoint is set and LoadCheckpoint reports progress past
+// `from`, the walk resumes from the checkpoint instead.
+//
+// The channel is closed once every block has been emitted, ctx is canceled,
+// or a fetch error occurs; in the error case the failing entry (with Err
+// set) is the last one sent.
+func IterateCanonicalBlocks(ctx context.Context, db kv.RoDB, from, to uint64, opts IterateOpts) <-chan BlockEntry {
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = 4
+	}
+	prefetch := opts.Prefetch
+	if prefetch <= 0 {
+		prefetch = 2 * workers
+	}
+
+	if opts.Checkpoint != "" {
+		if cp, ok, err := loadCheckpointFromDB(ctx, db, opts.Checkpoint); err == nil && ok && cp > from {
+			from = cp
+		}
+	}
+
+	out := make(chan BlockEntry)
+	if from >= to {
+		close(out)
+		return out
+	}
+	ctx, cancel := context.WithCancel(ctx)
+
+	jobs := make(chan uint64)
+	sem := make(chan struct{}, prefetch)
+
+	var slotsMu sync.Mutex
+	slots := make(map[uint64]chan BlockEntry)
+	slotFor := func(n uint64) chan BlockEntry {
+		slotsMu.Lock()
+		defer slotsMu.Unlock()
+		ch, ok := slots[n]
+		if !ok {
+			ch = make(chan BlockEntry, 1)
+			slots[n] = ch
+		}
+		return ch
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tx, err := db.BeginRo(ctx)
+			if err != nil {
+				for n := range jobs {
+					slotFor(n) <- BlockEntry{Number: n, Err: fmt.Errorf("chain iterator: open read tx: %w", err)}
+				}
+				return
+			}
+			defer tx.Rollback()
+			for n := range jobs {
+				slotFor(n) <- fetchBlockEntry(tx, n)
+			}
+		}()
+	}
+
+	go func() {
+		defer close(jobs)
+		for n := from; n < to; n++ {
+			select {
+			case <-ctx.Done():
+				return
+			case sem <- struct{}{}:
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case jobs <- n:
+			}
+		}
+	}()
+
+	go func() {
+		defer close(out)
+		defer wg.Wait()
+		// Runs before wg.Wait: it stops the dispatcher, which would otherwise
+		// stay blocked on sem after an early return on a fetch error.
+		defer cancel()
+		for n := from; n < to; n++ {
+			ch := slotFor(n)
+			var entry BlockEntry
+			select {
+			case <-ctx.Done():
+				return
+			case entry = <-ch:
+			}
+			<-sem
+			slotsMu.Lock()
+			delete(slots, n)
+			slotsMu.Unlock()
+
+			select {
+			case <-ctx.Done():
+				return
+			case out <- entry:
+			}
+			if entry.Err != nil {
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+func fetchBlockEntry(tx kv.Tx, n uint64) BlockEntry {
+	hashBytes, err := tx.GetOne(kv.HeaderCanonical, hexutility.EncodeTs(n))
+	if err != nil {
+		return BlockEntry{Number: n, Err: fmt.Errorf("read canonical hash: %w", err)}
+	}
+	if len(hashBytes) == 0 {
+		return BlockEntry{Number: n, Err: fmt.Errorf("block %d has no canonical hash", n)}
+	}
+	hash := common.BytesToHash(hashBytes)
+
+	header, err := tx.GetOne(kv.Headers, dbutils.HeaderKey(n, hash))
+	if err != nil {
+		return BlockEntry{Number: n, Hash: hash, Err: fmt.Errorf("read header: %w", err)}
+	}
+	body, err := tx.GetOne(kv.BlockBody, dbutils.BlockBodyKey(n, hash))
+	if err != nil {
+		return BlockEntry{Number: n, Hash: hash, Err: fmt.Errorf("read body: %w", err)}
+	}
+	senders, err := tx.GetOne(kv.Senders, dbutils.BlockBodyKey(n, hash))
+	if err != nil {
+		return BlockEntry{Number: n, Hash: hash, Err: fmt.Errorf("read senders: %w", err)}
+	}
+	receipts, err := tx.GetOne(kv.Receipts, hexutility.EncodeTs(n))
+	if err != nil {
+		return BlockEntry{Number: n, Hash: hash, Err: fmt.Errorf("read receipts: %w", err)}
+	}
+	td, err := tx.GetOne(kv.HeaderTD, dbutils.HeaderKey(n, hash))
+	if err != nil {
+		return BlockEntry{Number: n, Hash: hash, Err: fmt.Errorf("read total difficulty: %w", err)}
+	}
+
+	return BlockEntry{
+		Number:          n,
+		Hash:            hash,
+		Header:          header,
+		Body:            body,
+		Senders:         senders,
+		Receipts:        receipts,
+		TotalDifficulty: td,
+	}
+}
+
+// checkpointTablePrefix namespaces ChainIterator checkpoints within
+// kv.SyncStageProgress, alongside stage-loop progress keys.
+const checkpointTablePrefix = "blockio.chainiterator."
+
+// SaveCheckpoint durably records that `consumer` has processed every block
+// below blockNum, so a later LoadCheckpoint can resume the walk there.
+func SaveCheckpoint(tx kv.Putter, consumer string, blockNum uint64) error {
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, blockNum)
+	return tx.Put(kv.SyncStageProgress, []byte(checkpointTablePrefix+consumer), v)
+}
+
+// LoadCheckpoint returns the block number saved by the most recent
+// SaveCheckpoint for consumer, or ok=false if none was ever saved.
+func LoadCheckpoint(tx kv.Getter, consumer string) (blockNum uint64, ok bool, err error) {
+	v, err := tx.GetOne(kv.SyncStageProgress, []byte(checkpointTablePrefix+consumer))
+	if err != nil {
+		return 0, false, err
+	}
+	if len(v) == 0 {
+		return 0, false, nil
+	}
+	return binary.BigEndian.Uint64(v), true, nil
+}
+
+// loadCheckpointFromDB is LoadCheckpoint for callers, like
+// IterateCanonicalBlocks, that only have a kv.RoDB rather than an
+// already-open tx.
+func loadCheckpointFromDB(ctx context.Context, db kv.RoDB, consumer string) (uint64, bool, error) {
+	tx, err := db.BeginRo(ctx)
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+	return LoadCheckpoint(tx, consumer)
+}
@@ -0,0 +1,47 @@
+package blockio
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+
+	"github.com/ledgerwatch/erigon/core/rawdb/freezer"
+)
+
+// freezeBlocks streams blocks [frz.Frozen(), to) out of db into frz, in
+// order, via IterateCanonicalBlocks, and fsyncs once the batch is written.
+// It never writes to the KV tables it reads from: the caller is responsible
+// for only pruning the KV copy once this returns nil.
+//
+// The range is capped at blocksDeleteLimit blocks per call, same as the
+// hard-delete and tombstone-compaction paths, so that enabling freezing
+// against a long-lived chain doesn't try to freeze the entire ancient range
+// synchronously inside a single PruneBlocks call; callers drive it to
+// completion the same way, by calling PruneBlocks repeatedly.
+func freezeBlocks(ctx context.Context, db kv.RoDB, frz *freezer.Freezer, to uint64, blocksDeleteLimit int) error {
+	from := frz.Frozen()
+	if to > from+uint64(blocksDeleteLimit) {
+		to = from + uint64(blocksDeleteLimit)
+	}
+	if to <= from {
+		return nil
+	}
+	entries := IterateCanonicalBlocks(ctx, db, from, to, IterateOpts{})
+	for entry := range entries {
+		if entry.Err != nil {
+			return fmt.Errorf("freeze block %d: %w", entry.Number, entry.Err)
+		}
+		columns := map[string][]byte{
+			freezer.Headers:    entry.Header,
+			freezer.Bodies:     entry.Body,
+			freezer.Receipts:   entry.Receipts,
+			freezer.Hashes:     entry.Hash.Bytes(),
+			freezer.Difficulty: entry.TotalDifficulty,
+		}
+		if _, err := frz.AppendBlock(entry.Number, columns); err != nil {
+			return fmt.Errorf("freeze block %d: %w", entry.Number, err)
+		}
+	}
+	return frz.Sync()
+}
@@ -0,0 +1,154 @@
+package blockio
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/common/hexutility"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/bitmapdb"
+	"github.com/ledgerwatch/erigon/core/types"
+	"github.com/ledgerwatch/erigon/rlp"
+
+	"github.com/RoaringBitmap/roaring/roaring64"
+	"github.com/ugorji/go/codec"
+)
+
+// receiptsCborHandle matches the codec erigon's own rawdb.ReadReceipts uses
+// to decode kv.Receipts: unlike headers/bodies, receipts are stored as
+// cbor, not RLP.
+var receiptsCborHandle = func() *codec.CborHandle {
+	h := new(codec.CborHandle)
+	h.ReaderBufferSize = 1024
+	return h
+}()
+
+// decodeStoredReceipts decodes a kv.Receipts value. Logs are embedded in
+// this representation but without their derived fields (BlockNumber,
+// TxHash, ...) - fine for the log index, which only needs Address/Topics.
+func decodeStoredReceipts(data []byte) (types.Receipts, error) {
+	var receipts types.Receipts
+	if err := codec.NewDecoderBytes(data, receiptsCborHandle).Decode(&receipts); err != nil {
+		return nil, err
+	}
+	return receipts, nil
+}
+
+// IndexKind identifies a secondary index RebuildIndexes can derive from a
+// canonical-block walk.
+type IndexKind int
+
+const (
+	IndexTxLookup IndexKind = iota
+	IndexLogIndex
+)
+
+// RebuildIndexes derives one or more secondary indexes for canonical blocks
+// [from, to) in a single pass over IterateCanonicalBlocks, instead of
+// walking the range once per index. Progress is checkpointed under
+// `consumer` so a restarted rebuild resumes rather than starting at `from`
+// again.
+func (w *BlockWriter) RebuildIndexes(ctx context.Context, db kv.RoDB, tx kv.RwTx, from, to uint64, consumer string, kinds ...IndexKind) error {
+	entries := IterateCanonicalBlocks(ctx, db, from, to, IterateOpts{Checkpoint: consumer})
+	for entry := range entries {
+		if entry.Err != nil {
+			return fmt.Errorf("rebuild indexes: %w", entry.Err)
+		}
+		for _, kind := range kinds {
+			if err := applyIndex(tx, kind, entry); err != nil {
+				return fmt.Errorf("rebuild indexes: block %d: %w", entry.Number, err)
+			}
+		}
+		if consumer != "" {
+			if err := SaveCheckpoint(tx, consumer, entry.Number+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func applyIndex(tx kv.RwTx, kind IndexKind, entry BlockEntry) error {
+	switch kind {
+	case IndexTxLookup:
+		return rebuildTxLookup(tx, entry)
+	case IndexLogIndex:
+		return rebuildLogIndex(tx, entry)
+	default:
+		return fmt.Errorf("unknown index kind %d", kind)
+	}
+}
+
+// rebuildTxLookup maps every transaction hash in the block back to its
+// block number, mirroring what rawdb.WriteTxLookupEntries does at import
+// time.
+func rebuildTxLookup(tx kv.RwTx, entry BlockEntry) error {
+	var body types.BodyForStorage
+	if err := rlp.DecodeBytes(entry.Body, &body); err != nil {
+		return fmt.Errorf("decode body: %w", err)
+	}
+	blockNumBytes := hexutility.EncodeTs(entry.Number)
+	for txID := body.BaseTxId; txID < body.BaseTxId+uint64(body.TxAmount); txID++ {
+		txnRLP, err := tx.GetOne(kv.EthTx, hexutility.EncodeTs(txID))
+		if err != nil {
+			return err
+		}
+		if len(txnRLP) == 0 {
+			continue
+		}
+		txn, err := types.DecodeTransaction(txnRLP)
+		if err != nil {
+			return fmt.Errorf("decode tx %d: %w", txID, err)
+		}
+		if err := tx.Put(kv.TxLookup, txn.Hash().Bytes(), blockNumBytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebuildLogIndex adds this block's number to the per-address and
+// per-topic roaring bitmaps used to answer eth_getLogs range queries,
+// mirroring the stage_log_index collector but applied one block at a time.
+func rebuildLogIndex(tx kv.RwTx, entry BlockEntry) error {
+	if len(entry.Receipts) == 0 {
+		return nil
+	}
+	receipts, err := decodeStoredReceipts(entry.Receipts)
+	if err != nil {
+		return fmt.Errorf("decode receipts: %w", err)
+	}
+
+	byAddress := make(map[common.Address]*roaring64.Bitmap)
+	byTopic := make(map[common.Hash]*roaring64.Bitmap)
+	for _, r := range receipts {
+		for _, l := range r.Logs {
+			bm, ok := byAddress[l.Address]
+			if !ok {
+				bm = roaring64.New()
+				byAddress[l.Address] = bm
+			}
+			bm.Add(entry.Number)
+			for _, t := range l.Topics {
+				tbm, ok := byTopic[t]
+				if !ok {
+					tbm = roaring64.New()
+					byTopic[t] = tbm
+				}
+				tbm.Add(entry.Number)
+			}
+		}
+	}
+	for addr, bm := range byAddress {
+		if err := bitmapdb.AppendMergeByOr(tx, kv.LogAddressIndex, addr.Bytes(), bm); err != nil {
+			return err
+		}
+	}
+	for topic, bm := range byTopic {
+		if err := bitmapdb.AppendMergeByOr(tx, kv.LogTopicIndex, topic.Bytes(), bm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package blockio
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon/core/types"
+
+	"github.com/ugorji/go/codec"
+)
+
+// TestDecodeStoredReceiptsUsesCbor guards against a regression where
+// rebuildLogIndex decoded kv.Receipts values with rlp.DecodeBytes: unlike
+// headers and bodies, erigon stores receipts as cbor, so that decode failed
+// on every real receipts value (it only ever "worked" against empty/malformed
+// test input).
+func TestDecodeStoredReceiptsUsesCbor(t *testing.T) {
+	addr := common.HexToAddress("0x00000000000000000000000000000000000001")
+	topic := common.HexToHash("0x01")
+	want := types.Receipts{
+		{Logs: []*types.Log{{Address: addr, Topics: []common.Hash{topic}}}},
+	}
+
+	var buf bytes.Buffer
+	if err := codec.NewEncoder(&buf, receiptsCborHandle).Encode(want); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	got, err := decodeStoredReceipts(buf.Bytes())
+	if err != nil {
+		t.Fatalf("decodeStoredReceipts: %v", err)
+	}
+	if len(got) != 1 || len(got[0].Logs) != 1 {
+		t.Fatalf("got %+v, want one receipt with one log", got)
+	}
+	if got[0].Logs[0].Address != addr {
+		t.Fatalf("log address = %x, want %x", got[0].Logs[0].Address, addr)
+	}
+	if len(got[0].Logs[0].Topics) != 1 || got[0].Logs[0].Topics[0] != topic {
+		t.Fatalf("log topics = %v, want [%x]", got[0].Logs[0].Topics, topic)
+	}
+}
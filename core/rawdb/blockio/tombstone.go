@@ -0,0 +1,490 @@
+package blockio
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/metrics"
+)
+
+// PruneMode selects how BlockWriter.PruneBlocks / PruneBorBlocks get rid of
+// old data.
+type PruneMode uint8
+
+const (
+	// PruneModeHard physically deletes rows, as PruneBlocks always used to.
+	PruneModeHard PruneMode = iota
+	// PruneModeSoft writes tombstones instead of deleting: the data stays
+	// on disk but reads must treat it as absent (see BlockWriter.IsPruned).
+	// CompactTombstones later turns soft-pruned ranges into real deletes.
+	PruneModeSoft
+)
+
+// Tombstone marks [BlockFrom, BlockTo) of `Table` as soft-pruned at
+// PrunedAt (unix seconds). KeyFrom/KeyTo are the literal KV key bounds that
+// CompactTombstones will eventually delete.
+type Tombstone struct {
+	Table     string
+	KeyFrom   []byte
+	KeyTo     []byte
+	PrunedAt  uint64
+	BlockFrom uint64
+	BlockTo   uint64
+}
+
+func (t Tombstone) marshal() []byte {
+	buf := make([]byte, 8+8+8+2+len(t.KeyFrom)+2+len(t.KeyTo))
+	off := 0
+	binary.BigEndian.PutUint64(buf[off:], t.PrunedAt)
+	off += 8
+	binary.BigEndian.PutUint64(buf[off:], t.BlockFrom)
+	off += 8
+	binary.BigEndian.PutUint64(buf[off:], t.BlockTo)
+	off += 8
+	binary.BigEndian.PutUint16(buf[off:], uint16(len(t.KeyFrom)))
+	off += 2
+	off += copy(buf[off:], t.KeyFrom)
+	binary.BigEndian.PutUint16(buf[off:], uint16(len(t.KeyTo)))
+	off += 2
+	copy(buf[off:], t.KeyTo)
+	return buf
+}
+
+func unmarshalTombstone(table string, v []byte) (Tombstone, error) {
+	if len(v) < 28 {
+		return Tombstone{}, fmt.Errorf("tombstone record too short: %d bytes", len(v))
+	}
+	t := Tombstone{Table: table}
+	off := 0
+	t.PrunedAt = binary.BigEndian.Uint64(v[off:])
+	off += 8
+	t.BlockFrom = binary.BigEndian.Uint64(v[off:])
+	off += 8
+	t.BlockTo = binary.BigEndian.Uint64(v[off:])
+	off += 8
+	keyFromLen := int(binary.BigEndian.Uint16(v[off:]))
+	off += 2
+	t.KeyFrom = v[off : off+keyFromLen]
+	off += keyFromLen
+	keyToLen := int(binary.BigEndian.Uint16(v[off:]))
+	off += 2
+	t.KeyTo = v[off : off+keyToLen]
+	return t, nil
+}
+
+// tombstoneKey sorts tombstones within kv.PruneTombstones by table, then by
+// the first pruned block, so CompactTombstones/UnwindPrune can range-scan
+// one table's entries in block order.
+func tombstoneKey(table string, blockFrom uint64) []byte {
+	k := make([]byte, len(table)+1+8)
+	copy(k, table)
+	k[len(table)] = 0 // separator: table names never contain NUL
+	binary.BigEndian.PutUint64(k[len(table)+1:], blockFrom)
+	return k
+}
+
+// tombstoneTablePrefix is the kv.PruneTombstones key prefix covering every
+// tombstone recorded for `table`.
+func tombstoneTablePrefix(table string) []byte {
+	return []byte(table + "\x00")
+}
+
+const (
+	tombstoneBloomWords = 1 << 14 // 1Mi bits (128KiB), shared across all tables
+	tombstoneBloomK     = 3
+)
+
+type blockRange struct{ from, to uint64 }
+
+type tombstoneBloom struct {
+	bits []uint64
+}
+
+func newTombstoneBloom() *tombstoneBloom {
+	return &tombstoneBloom{bits: make([]uint64, tombstoneBloomWords)}
+}
+
+func (b *tombstoneBloom) clone() *tombstoneBloom {
+	c := &tombstoneBloom{bits: make([]uint64, len(b.bits))}
+	copy(c.bits, b.bits)
+	return c
+}
+
+func (b *tombstoneBloom) add(h1, h2 uint64) {
+	m := uint64(len(b.bits)) * 64
+	for i := uint64(0); i < tombstoneBloomK; i++ {
+		idx := (h1 + i*h2) % m
+		b.bits[idx/64] |= 1 << (idx % 64)
+	}
+}
+
+func (b *tombstoneBloom) mayContain(h1, h2 uint64) bool {
+	m := uint64(len(b.bits)) * 64
+	for i := uint64(0); i < tombstoneBloomK; i++ {
+		idx := (h1 + i*h2) % m
+		if b.bits[idx/64]&(1<<(idx%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// tombstoneHash computes two independent 64-bit hashes of (table, blockNum)
+// without allocating, for Kirsch-Mitzenmacher double hashing.
+func tombstoneHash(table string, blockNum uint64) (h1, h2 uint64) {
+	const (
+		offset64 = 14695981039346656037
+		prime64  = 1099511628211
+	)
+	h := uint64(offset64)
+	for i := 0; i < len(table); i++ {
+		h ^= uint64(table[i])
+		h *= prime64
+	}
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], blockNum)
+	for _, c := range buf {
+		h ^= uint64(c)
+		h *= prime64
+	}
+	h1 = h
+	// h2 runs h1 through the murmur3 64-bit finalizer.
+	h2 = h ^ h>>33
+	h2 *= 0xff51afd7ed558ccd
+	h2 ^= h2 >> 33
+	h2 *= 0xc4ceb9fe1a85ec53
+	h2 ^= h2 >> 33
+	return h1, h2
+}
+
+// tombstoneState is an immutable snapshot of every live tombstone range, so
+// that IsPruned can read it without locking. Mutations (soft-prune,
+// compact, unwind) build a new state and atomically swap it in.
+type tombstoneState struct {
+	bloom  *tombstoneBloom
+	ranges map[string][]blockRange // sorted by .from, per table
+}
+
+func newTombstoneState() *tombstoneState {
+	return &tombstoneState{bloom: newTombstoneBloom(), ranges: make(map[string][]blockRange)}
+}
+
+func (s *tombstoneState) withAdded(table string, from, to uint64) *tombstoneState {
+	next := &tombstoneState{bloom: s.bloom.clone(), ranges: make(map[string][]blockRange, len(s.ranges))}
+	for k, v := range s.ranges {
+		next.ranges[k] = v
+	}
+	for n := from; n < to; n++ {
+		h1, h2 := tombstoneHash(table, n)
+		next.bloom.add(h1, h2)
+	}
+	rs := append(append([]blockRange(nil), s.ranges[table]...), blockRange{from, to})
+	sort.Slice(rs, func(i, j int) bool { return rs[i].from < rs[j].from })
+	next.ranges[table] = rs
+	return next
+}
+
+func (s *tombstoneState) withRemoved(table string, from, to uint64) *tombstoneState {
+	next := &tombstoneState{bloom: s.bloom, ranges: make(map[string][]blockRange, len(s.ranges))}
+	for k, v := range s.ranges {
+		next.ranges[k] = v
+	}
+	kept := next.ranges[table][:0:0]
+	for _, r := range next.ranges[table] {
+		if r.from >= from && r.to <= to {
+			continue // fully covered by [from, to): drop it
+		}
+		kept = append(kept, r)
+	}
+	next.ranges[table] = kept
+	// The bloom filter is a may-contain structure with no delete operation;
+	// leaving stale bits set only costs IsPruned an extra range-list lookup
+	// that correctly returns false, never a false negative.
+	return next
+}
+
+// IsPruned reports whether blockNum's row in `table` has been soft-pruned.
+// The hot path is a single bloom check; the per-table range list (the only
+// allocation-bearing structure here) is consulted only when the bloom
+// filter says "maybe present".
+func (w *BlockWriter) IsPruned(table string, blockNum uint64) bool {
+	st := w.tombstones.Load()
+	if st == nil {
+		return false
+	}
+	h1, h2 := tombstoneHash(table, blockNum)
+	if !st.bloom.mayContain(h1, h2) {
+		return false
+	}
+	ranges := st.ranges[table]
+	i := sort.Search(len(ranges), func(i int) bool { return ranges[i].to > blockNum })
+	return i < len(ranges) && ranges[i].from <= blockNum
+}
+
+var mxTombstonesWritten = map[string]*metrics.Summary{}
+
+func tombstoneMetric(table string) *metrics.Summary {
+	m, ok := mxTombstonesWritten[table]
+	if !ok {
+		m = metrics.GetOrCreateSummary(fmt.Sprintf(`prune_tombstones{table=%q}`, table))
+		mxTombstonesWritten[table] = m
+	}
+	return m
+}
+
+// tombstonedTables are the columns PruneBlocks would otherwise physically
+// delete; see rawdb.PruneBlocks's doc-comment for why Receipts, Senders,
+// Canonical markers and TotalDifficulty are left alone.
+var tombstonedTables = []string{kv.Headers, kv.BlockBody}
+
+// LoadTombstones rebuilds the in-memory tombstone state that backs IsPruned
+// from kv.PruneTombstones. NewBlockWriter starts with empty state, since it
+// has no tx to read from yet; callers must call LoadTombstones once, with a
+// read tx open against the same db, before trusting IsPruned - otherwise
+// every block soft-pruned in a previous process run reports IsPruned==false
+// until softPruneBlocks happens to cover it again. It is safe to call more
+// than once (e.g. after a long-running process reopens its db); the loaded
+// state simply replaces whatever was there before.
+func (w *BlockWriter) LoadTombstones(tx kv.Tx) error {
+	next := newTombstoneState()
+	for _, table := range tombstonedTables {
+		prefix := tombstoneTablePrefix(table)
+		if err := tx.ForPrefix(kv.PruneTombstones, prefix, func(_, v []byte) error {
+			t, err := unmarshalTombstone(table, v)
+			if err != nil {
+				return err
+			}
+			next = next.withAdded(table, t.BlockFrom, t.BlockTo)
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+	w.tombstones.Store(next)
+	return nil
+}
+
+// tombstoneHighWatermark returns the largest BlockTo recorded for `table` in
+// kv.PruneTombstones, i.e. the first block not yet soft-pruned. It is
+// derived from the durable table rather than in-memory state so that
+// softPruneBlocks resumes correctly across process restarts, not just
+// across repeated calls within one BlockWriter's lifetime.
+func tombstoneHighWatermark(tx kv.Tx, table string) (uint64, error) {
+	var maxTo uint64
+	if err := tx.ForPrefix(kv.PruneTombstones, tombstoneTablePrefix(table), func(_, v []byte) error {
+		t, err := unmarshalTombstone(table, v)
+		if err != nil {
+			return err
+		}
+		if t.BlockTo > maxTo {
+			maxTo = t.BlockTo
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	return maxTo, nil
+}
+
+// softPruneBlocks writes tombstones for the next batch of blocks after
+// whatever has already been soft-pruned, instead of deleting, bounded by
+// blocksDeleteLimit exactly like the hard-delete path.
+func (w *BlockWriter) softPruneBlocks(tx kv.RwTx, blockTo uint64, blocksDeleteLimit int) (int, error) {
+	const keepGenesis = 1
+	var from uint64
+	for _, table := range tombstonedTables {
+		wm, err := tombstoneHighWatermark(tx, table)
+		if err != nil {
+			return 0, err
+		}
+		if wm == 0 {
+			wm = keepGenesis
+		}
+		if wm > from {
+			from = wm
+		}
+	}
+	to := blockTo
+	if to > from+uint64(blocksDeleteLimit) {
+		to = from + uint64(blocksDeleteLimit)
+	}
+	if to <= from {
+		return 0, nil
+	}
+	prunedAt := uint64(time.Now().Unix())
+	for _, table := range tombstonedTables {
+		t := Tombstone{
+			Table:     table,
+			KeyFrom:   blockTombstoneKey(from),
+			KeyTo:     blockTombstoneKey(to),
+			PrunedAt:  prunedAt,
+			BlockFrom: from,
+			BlockTo:   to,
+		}
+		if err := tx.Put(kv.PruneTombstones, tombstoneKey(table, from), t.marshal()); err != nil {
+			return 0, err
+		}
+		tombstoneMetric(table).Update(float64(to - from))
+	}
+	for {
+		cur := w.tombstones.Load()
+		next := cur
+		for _, table := range tombstonedTables {
+			next = next.withAdded(table, from, to)
+		}
+		if w.tombstones.CompareAndSwap(cur, next) {
+			break
+		}
+	}
+	return int(to - from), nil
+}
+
+func blockTombstoneKey(blockNum uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, blockNum)
+	return k
+}
+
+// CompactTombstones physically deletes rows covered by tombstones eligible
+// under either cutoff - PrunedAt older than olderThan, or BlockTo at or
+// below olderThanBlock - clearing the tombstone once its rows are gone. It
+// stops once it has deleted blocksDeleteLimit rows, so a caller can drive
+// it the same way as PruneBlocks: call repeatedly until compacted==0.
+func (w *BlockWriter) CompactTombstones(tx kv.RwTx, olderThan time.Duration, olderThanBlock uint64, blocksDeleteLimit int) (compacted int, err error) {
+	defer mxCompactTookBlocks.ObserveDuration(time.Now())
+
+	var cutoffTime uint64
+	if olderThan > 0 {
+		cutoffTime = uint64(time.Now().Add(-olderThan).Unix())
+	}
+
+	toDelete := make([]Tombstone, 0, 16)
+	for _, table := range tombstonedTables {
+		prefix := tombstoneTablePrefix(table)
+		if err := tx.ForPrefix(kv.PruneTombstones, prefix, func(k, v []byte) error {
+			if compacted >= blocksDeleteLimit {
+				return nil
+			}
+			t, err := unmarshalTombstone(table, v)
+			if err != nil {
+				return err
+			}
+			eligible := (olderThan > 0 && t.PrunedAt <= cutoffTime) || (olderThanBlock > 0 && t.BlockTo <= olderThanBlock)
+			if !eligible {
+				return nil
+			}
+			toDelete = append(toDelete, t)
+			compacted += int(t.BlockTo - t.BlockFrom)
+			return nil
+		}); err != nil {
+			return 0, err
+		}
+	}
+
+	for _, t := range toDelete {
+		if err := tx.ForEach(t.Table, t.KeyFrom, func(k, _ []byte) error {
+			if len(t.KeyTo) > 0 && string(k) >= string(t.KeyTo) {
+				return nil
+			}
+			return tx.Delete(t.Table, k)
+		}); err != nil {
+			return 0, err
+		}
+		if err := tx.Delete(kv.PruneTombstones, tombstoneKey(t.Table, t.BlockFrom)); err != nil {
+			return 0, err
+		}
+	}
+
+	for {
+		cur := w.tombstones.Load()
+		next := cur
+		for _, t := range toDelete {
+			next = next.withRemoved(t.Table, t.BlockFrom, t.BlockTo)
+		}
+		if w.tombstones.CompareAndSwap(cur, next) {
+			break
+		}
+	}
+	return compacted, nil
+}
+
+// UnwindPrune drops tombstone coverage for blocks >= blockFrom, restoring
+// visibility of rows that were soft-pruned but never physically deleted. A
+// tombstone that straddles blockFrom is split: [BlockFrom, blockFrom) stays
+// tombstoned and only [blockFrom, BlockTo) is released. It is the
+// reversible counterpart of softPruneBlocks and only works while
+// CompactTombstones hasn't yet run for that range.
+func (w *BlockWriter) UnwindPrune(tx kv.RwTx, blockFrom uint64) (restored int, err error) {
+	type change struct {
+		old  Tombstone
+		kept bool // true if [old.BlockFrom, blockFrom) remains tombstoned
+	}
+	changes := make([]change, 0, 16)
+	for _, table := range tombstonedTables {
+		prefix := tombstoneTablePrefix(table)
+		if err := tx.ForPrefix(kv.PruneTombstones, prefix, func(k, v []byte) error {
+			t, err := unmarshalTombstone(table, v)
+			if err != nil {
+				return err
+			}
+			if t.BlockTo <= blockFrom {
+				return nil // fully below the unwind point: stays pruned untouched
+			}
+			changes = append(changes, change{old: t, kept: t.BlockFrom < blockFrom})
+			return nil
+		}); err != nil {
+			return 0, err
+		}
+	}
+
+	// Every tombstoned table carries the same block ranges, so restored
+	// counts blocks once rather than once per table.
+	restoredByTable := make(map[string]int, len(tombstonedTables))
+	for _, c := range changes {
+		t := c.old
+		if err := tx.Delete(kv.PruneTombstones, tombstoneKey(t.Table, t.BlockFrom)); err != nil {
+			return 0, err
+		}
+		if c.kept {
+			kept := Tombstone{
+				Table:     t.Table,
+				KeyFrom:   t.KeyFrom,
+				KeyTo:     blockTombstoneKey(blockFrom),
+				PrunedAt:  t.PrunedAt,
+				BlockFrom: t.BlockFrom,
+				BlockTo:   blockFrom,
+			}
+			if err := tx.Put(kv.PruneTombstones, tombstoneKey(kept.Table, kept.BlockFrom), kept.marshal()); err != nil {
+				return 0, err
+			}
+			restoredByTable[t.Table] += int(t.BlockTo - blockFrom)
+		} else {
+			restoredByTable[t.Table] += int(t.BlockTo - t.BlockFrom)
+		}
+	}
+	for _, n := range restoredByTable {
+		if n > restored {
+			restored = n
+		}
+	}
+
+	for {
+		cur := w.tombstones.Load()
+		next := cur
+		for _, c := range changes {
+			next = next.withRemoved(c.old.Table, c.old.BlockFrom, c.old.BlockTo)
+			if c.kept {
+				next = next.withAdded(c.old.Table, c.old.BlockFrom, blockFrom)
+			}
+		}
+		if w.tombstones.CompareAndSwap(cur, next) {
+			break
+		}
+	}
+	return restored, nil
+}
+
+var mxCompactTookBlocks = metrics.GetOrCreateSummary(`prune_seconds{type="tombstone_compact"}`)
@@ -0,0 +1,102 @@
+package blockio
+
+import (
+	"testing"
+
+	"github.com/ledgerwatch/erigon-lib/kv/memdb"
+)
+
+// TestSoftPruneBlocksResumesFromWatermark guards against a regression
+// where softPruneBlocks always started at block 1, so repeated
+// PruneBlocks(..., PruneModeSoft) calls could never advance past the
+// first blocksDeleteLimit blocks.
+func TestSoftPruneBlocksResumesFromWatermark(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	w := NewBlockWriter()
+
+	deleted, err := w.softPruneBlocks(tx, 100, 10)
+	if err != nil {
+		t.Fatalf("softPruneBlocks #1: %v", err)
+	}
+	if deleted != 9 { // [1, 10)
+		t.Fatalf("softPruneBlocks #1 deleted = %d, want 9", deleted)
+	}
+
+	deleted, err = w.softPruneBlocks(tx, 100, 10)
+	if err != nil {
+		t.Fatalf("softPruneBlocks #2: %v", err)
+	}
+	if deleted != 10 { // [10, 20)
+		t.Fatalf("softPruneBlocks #2 deleted = %d, want 10 (did it restart at block 1?)", deleted)
+	}
+	if !w.IsPruned(tombstonedTables[0], 15) {
+		t.Fatal("block 15 should be soft-pruned after two batches")
+	}
+}
+
+// TestLoadTombstonesRebuildsStateAcrossRestart guards against a regression
+// where a fresh BlockWriter (as created after a process restart) never
+// consulted kv.PruneTombstones, so every block soft-pruned by a previous
+// run reported IsPruned==false until softPruneBlocks happened to cover it
+// again.
+func TestLoadTombstonesRebuildsStateAcrossRestart(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	w := NewBlockWriter()
+
+	if _, err := w.softPruneBlocks(tx, 10, 10); err != nil { // tombstones [1, 10)
+		t.Fatalf("softPruneBlocks: %v", err)
+	}
+
+	// A fresh BlockWriter simulates restarting the process: it has no
+	// in-memory knowledge of the tombstones already durably recorded.
+	fresh := NewBlockWriter()
+	table := tombstonedTables[0]
+	if fresh.IsPruned(table, 5) {
+		t.Fatal("fresh BlockWriter should report nothing pruned before LoadTombstones")
+	}
+
+	if err := fresh.LoadTombstones(tx); err != nil {
+		t.Fatalf("LoadTombstones: %v", err)
+	}
+	for b := uint64(1); b < 10; b++ {
+		if !fresh.IsPruned(table, b) {
+			t.Fatalf("block %d should be pruned after LoadTombstones", b)
+		}
+	}
+	if fresh.IsPruned(table, 10) {
+		t.Fatal("block 10 should not be pruned")
+	}
+}
+
+// TestUnwindPruneSplitsStraddlingTombstone guards against a regression
+// where UnwindPrune dropped an entire tombstone range even when only its
+// tail was >= blockFrom, incorrectly restoring already-pruned blocks
+// below blockFrom too.
+func TestUnwindPruneSplitsStraddlingTombstone(t *testing.T) {
+	_, tx := memdb.NewTestTx(t)
+	w := NewBlockWriter()
+
+	if _, err := w.softPruneBlocks(tx, 21, 20); err != nil { // tombstones [1, 20)
+		t.Fatalf("softPruneBlocks: %v", err)
+	}
+
+	restored, err := w.UnwindPrune(tx, 15)
+	if err != nil {
+		t.Fatalf("UnwindPrune: %v", err)
+	}
+	if restored != 5 { // [15, 20)
+		t.Fatalf("restored = %d, want 5", restored)
+	}
+
+	table := tombstonedTables[0]
+	for b := uint64(1); b < 15; b++ {
+		if !w.IsPruned(table, b) {
+			t.Fatalf("block %d should still be pruned below the unwind point", b)
+		}
+	}
+	for b := uint64(15); b < 20; b++ {
+		if w.IsPruned(table, b) {
+			t.Fatalf("block %d should have been restored", b)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+// Package freezer implements an append-only, size-capped ancient-blocks
+// store modeled on go-ethereum's freezer: each column (headers, bodies,
+// receipts, hashes, difficulty, ...) lives in its own set of mmap-backed
+// table files with a side index, so that blocks pruned out of the KV can
+// still be served without re-downloading them.
+package freezer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/ledgerwatch/erigon-lib/metrics"
+)
+
+const (
+	// DefaultMaxTableSize is the size at which a table's data file is sealed
+	// and a new one is started.
+	DefaultMaxTableSize = 2 * 1024 * 1024 * 1024 // 2Gb
+
+	Headers    = "headers"
+	Bodies     = "bodies"
+	Receipts   = "receipts"
+	Hashes     = "hashes"
+	Difficulty = "difficulty"
+)
+
+// DefaultTables is the column set used for ancient block storage.
+var DefaultTables = []string{Headers, Bodies, Receipts, Hashes, Difficulty}
+
+var (
+	mxFreezeTookBlocks  = metrics.GetOrCreateSummary(`freeze_seconds{type="blocks"}`)
+	mxFreezeBytesBlocks = metrics.GetOrCreateCounter(`freeze_bytes_written{type="blocks"}`)
+)
+
+// Freezer is an append-only ancient store: once a block has been frozen it
+// is immutable, and the store only ever grows at its head or shrinks via
+// Truncate (used by unwind). The "frozen head" is the number of the first
+// block NOT yet present in the freezer, i.e. items live in [0, Frozen()).
+type Freezer struct {
+	dir string
+
+	tables map[string]*freezerTable
+	// order is the table name order AppendBlock/Sync/Truncate/Close iterate
+	// in, fixed at NewFreezer time. Iterating f.tables directly would walk a
+	// Go map in random order, which for AppendBlock in particular makes
+	// which table the missing-column check fails on (and hence which
+	// tables actually need rolling back) non-deterministic from one call to
+	// the next.
+	order  []string
+	frozen atomic.Uint64
+}
+
+// NewFreezer opens (creating if necessary) a freezer rooted at dir, with one
+// table per entry in `tables`. All tables are expected to advance in
+// lock-step; Frozen() reports the minimum item count across them.
+func NewFreezer(dir string, tables []string, maxTableSize uint32) (*Freezer, error) {
+	if maxTableSize == 0 {
+		maxTableSize = DefaultMaxTableSize
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("freezer: create dir %q: %w", dir, err)
+	}
+	f := &Freezer{
+		dir:    dir,
+		tables: make(map[string]*freezerTable, len(tables)),
+		order:  append([]string(nil), tables...),
+	}
+	var min uint64 = ^uint64(0)
+	for _, name := range tables {
+		t, err := newFreezerTable(dir, name, maxTableSize)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		f.tables[name] = t
+		if n := t.Items(); n < min {
+			min = n
+		}
+	}
+	if len(tables) == 0 {
+		min = 0
+	}
+	f.frozen.Store(min)
+	return f, nil
+}
+
+// Frozen returns the number of the first block not yet present in the
+// freezer: items [0, Frozen()) are stored, everything else lives in the KV.
+func (f *Freezer) Frozen() uint64 { return f.frozen.Load() }
+
+// AppendBlock writes one block's worth of columns, keyed by block number,
+// to every named table and advances the frozen head once all of them agree
+// on the new item count. Every call must supply exactly the tables this
+// Freezer was opened with, for block number == f.Frozen().
+//
+// A table that has already accepted item `number` by the time another
+// table fails is rolled back to `number` before returning, so f.Frozen()
+// and every table's item count stay in lock-step even on a partial
+// failure: the caller can simply retry AppendBlock(number, ...) rather
+// than getting wedged behind a table that's one item ahead.
+func (f *Freezer) AppendBlock(number uint64, columns map[string][]byte) (bytesWritten int, err error) {
+	defer mxFreezeTookBlocks.ObserveDuration(time.Now())
+
+	if number != f.Frozen() {
+		return 0, fmt.Errorf("freezer: out-of-order freeze, want block %d, got %d", f.Frozen(), number)
+	}
+	appended := make([]*freezerTable, 0, len(f.tables))
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, t := range appended {
+			if rerr := t.TruncateHead(number); rerr != nil {
+				err = fmt.Errorf("%w (and rollback of %q failed: %v)", err, t.name, rerr)
+			}
+		}
+	}()
+	for _, name := range f.order {
+		t := f.tables[name]
+		data, ok := columns[name]
+		if !ok {
+			err = fmt.Errorf("freezer: missing column %q for block %d", name, number)
+			return bytesWritten, err
+		}
+		if aerr := t.Append(number, data); aerr != nil {
+			err = aerr
+			return bytesWritten, err
+		}
+		appended = append(appended, t)
+		bytesWritten += len(data)
+	}
+	f.frozen.Store(number + 1)
+	mxFreezeBytesBlocks.Add(bytesWritten)
+	return bytesWritten, nil
+}
+
+// Sync fsyncs every table's head data file and index file, so that a crash
+// after Sync cannot lose anything already reported via Frozen().
+func (f *Freezer) Sync() error {
+	for _, name := range f.order {
+		if err := f.tables[name].head.Sync(); err != nil {
+			return fmt.Errorf("freezer: fsync %q: %w", name, err)
+		}
+		if err := f.tables[name].index.Sync(); err != nil {
+			return fmt.Errorf("freezer: fsync index of %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// ReadBlock returns the raw column bytes for block `number`, or an error if
+// the block hasn't been frozen yet.
+func (f *Freezer) ReadBlock(table string, number uint64) ([]byte, error) {
+	t, ok := f.tables[table]
+	if !ok {
+		return nil, fmt.Errorf("freezer: unknown table %q", table)
+	}
+	return t.Retrieve(number)
+}
+
+// HasBlock reports whether block `number` is below the frozen head, i.e.
+// whether reads for it should fall through to the freezer rather than KV.
+func (f *Freezer) HasBlock(number uint64) bool {
+	return number < f.Frozen()
+}
+
+// Truncate discards frozen blocks [head, Frozen()), for unwind support. It
+// is a no-op if head >= Frozen().
+func (f *Freezer) Truncate(head uint64) error {
+	if head >= f.Frozen() {
+		return nil
+	}
+	for _, name := range f.order {
+		if err := f.tables[name].TruncateHead(head); err != nil {
+			return fmt.Errorf("freezer: truncate %q to %d: %w", name, head, err)
+		}
+	}
+	f.frozen.Store(head)
+	return nil
+}
+
+func (f *Freezer) Close() error {
+	var firstErr error
+	for _, name := range f.order {
+		if err := f.tables[name].Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Dir returns the directory the freezer was opened with, mainly for tests
+// and diagnostics.
+func (f *Freezer) Dir() string { return filepath.Clean(f.dir) }
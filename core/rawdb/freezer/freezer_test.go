@@ -0,0 +1,34 @@
+package freezer
+
+import "testing"
+
+// TestFreezerAppendBlockRollback guards against a regression where a
+// partial AppendBlock failure (one table accepted the item, another
+// didn't) left the tables out of lock-step with Frozen(), wedging every
+// future retry behind an "out-of-order append" error.
+func TestFreezerAppendBlockRollback(t *testing.T) {
+	dir := t.TempDir()
+	f, err := NewFreezer(dir, []string{Headers, Bodies}, 0)
+	if err != nil {
+		t.Fatalf("NewFreezer: %v", err)
+	}
+	defer f.Close()
+
+	// Missing the Bodies column simulates a table-specific failure after
+	// Headers has already been appended.
+	if _, err := f.AppendBlock(0, map[string][]byte{Headers: []byte("h0")}); err == nil {
+		t.Fatal("expected AppendBlock to fail on missing column")
+	}
+	if got := f.Frozen(); got != 0 {
+		t.Fatalf("Frozen() = %d after failed append, want 0", got)
+	}
+
+	// A retry with the complete column set must succeed, proving Headers
+	// was rolled back rather than left one item ahead.
+	if _, err := f.AppendBlock(0, map[string][]byte{Headers: []byte("h0"), Bodies: []byte("b0")}); err != nil {
+		t.Fatalf("AppendBlock after rollback: %v", err)
+	}
+	if got := f.Frozen(); got != 1 {
+		t.Fatalf("Frozen() = %d after successful retry, want 1", got)
+	}
+}
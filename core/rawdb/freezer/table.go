@@ -0,0 +1,320 @@
+package freezer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	mmap "github.com/edsrzf/mmap-go"
+)
+
+// indexEntrySize is the size (in bytes) of one entry in a table's .ridx file:
+// a 4-byte file number followed by a 4-byte end-offset within that file.
+// Entry i stores the end-offset of item i, so the byte range of item i is
+// [entry(i-1).offset, entry(i).offset) within file entry(i).fileNum, or
+// [0, entry(i).offset) when item i is the first item of its file.
+const indexEntrySize = 8
+
+// recordHeaderSize is the size of the per-record CRC32 checksum that
+// precedes every item's payload in a data file.
+const recordHeaderSize = 4
+
+type indexEntry struct {
+	fileNum uint32
+	offset  uint32
+}
+
+func (e indexEntry) marshal() []byte {
+	buf := make([]byte, indexEntrySize)
+	binary.BigEndian.PutUint32(buf[:4], e.fileNum)
+	binary.BigEndian.PutUint32(buf[4:], e.offset)
+	return buf
+}
+
+func unmarshalIndexEntry(b []byte) indexEntry {
+	return indexEntry{
+		fileNum: binary.BigEndian.Uint32(b[:4]),
+		offset:  binary.BigEndian.Uint32(b[4:]),
+	}
+}
+
+// freezerTable is a single append-only, size-capped column of the freezer
+// (e.g. headers, bodies, receipts). Items are numbered sequentially starting
+// at 0 and are immutable once written. Each item is prefixed in its data
+// file with a CRC32 checksum of its payload, and a side .ridx file records
+// the (fileNum, endOffset) of every item for O(1) random access.
+//
+// Once a data file reaches maxFileSize it is mmapped read-only and a fresh
+// file is opened for subsequent appends; only the head file is ever opened
+// for writing.
+type freezerTable struct {
+	name        string
+	dir         string
+	maxFileSize uint32
+
+	lock sync.RWMutex
+
+	head      *os.File // current (writable) data file
+	headNum   uint32
+	headBytes uint32 // bytes written into head so far
+
+	files map[uint32]mmap.MMap // read-only mmaps of sealed files; the head file is read with ReadAt
+
+	index     *os.File
+	items     uint64 // number of items currently stored
+	indexSize int64  // size of the index file, in bytes
+}
+
+func newFreezerTable(dir, name string, maxFileSize uint32) (*freezerTable, error) {
+	t := &freezerTable{
+		name:        name,
+		dir:         dir,
+		maxFileSize: maxFileSize,
+		files:       make(map[uint32]mmap.MMap),
+	}
+	idx, err := os.OpenFile(t.indexPath(), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("freezer: open index for %q: %w", name, err)
+	}
+	t.index = idx
+	if err := t.repair(); err != nil {
+		idx.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *freezerTable) indexPath() string {
+	return filepath.Join(t.dir, t.name+".ridx")
+}
+
+func (t *freezerTable) dataPath(fileNum uint32) string {
+	return filepath.Join(t.dir, fmt.Sprintf("%s.%04d.rdat", t.name, fileNum))
+}
+
+// repair reconstructs in-memory bookkeeping (item count, head file/offset)
+// from whatever is already on disk, and opens the head data file for
+// appending.
+func (t *freezerTable) repair() error {
+	stat, err := t.index.Stat()
+	if err != nil {
+		return err
+	}
+	t.items = uint64(stat.Size() / indexEntrySize)
+	t.indexSize = stat.Size()
+
+	var last indexEntry
+	if t.items > 0 {
+		buf := make([]byte, indexEntrySize)
+		if _, err := t.index.ReadAt(buf, stat.Size()-indexEntrySize); err != nil {
+			return err
+		}
+		last = unmarshalIndexEntry(buf)
+	}
+	t.headNum = last.fileNum
+	if t.head != nil {
+		if err := t.head.Close(); err != nil {
+			return err
+		}
+	}
+	head, err := os.OpenFile(t.dataPath(t.headNum), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	t.head = head
+	t.headBytes = last.offset
+	if err := head.Truncate(int64(last.offset)); err != nil {
+		return err
+	}
+	// Without O_APPEND the write offset starts at 0; move it to the end of
+	// the last item so the next Append does not overwrite existing items.
+	_, err = head.Seek(int64(last.offset), io.SeekStart)
+	return err
+}
+
+// Append writes one item's payload, prefixed with its CRC32 checksum, and
+// records its bounds in the index. Items must be appended in order.
+func (t *freezerTable) Append(item uint64, data []byte) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if item != t.items {
+		return fmt.Errorf("freezer: out-of-order append to %q, want item %d, got %d", t.name, t.items, item)
+	}
+	if t.headBytes > 0 && t.headBytes+uint32(recordHeaderSize+len(data)) > t.maxFileSize {
+		if err := t.rotate(); err != nil {
+			return err
+		}
+	}
+
+	rec := make([]byte, recordHeaderSize+len(data))
+	binary.BigEndian.PutUint32(rec[:recordHeaderSize], crc32.ChecksumIEEE(data))
+	copy(rec[recordHeaderSize:], data)
+	if _, err := t.head.Write(rec); err != nil {
+		return err
+	}
+	t.headBytes += uint32(len(rec))
+
+	entry := indexEntry{fileNum: t.headNum, offset: t.headBytes}
+	if _, err := t.index.Write(entry.marshal()); err != nil {
+		return err
+	}
+	t.indexSize += indexEntrySize
+	t.items++
+	return nil
+}
+
+// rotate seals the current head file (mmapping it read-only for future
+// reads) and opens a fresh, empty one.
+func (t *freezerTable) rotate() error {
+	if err := t.head.Sync(); err != nil {
+		return err
+	}
+	if err := t.mmapFile(t.headNum); err != nil {
+		return err
+	}
+	if err := t.head.Close(); err != nil {
+		return err
+	}
+	t.headNum++
+	t.headBytes = 0
+	head, err := os.OpenFile(t.dataPath(t.headNum), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	t.head = head
+	return nil
+}
+
+func (t *freezerTable) mmapFile(fileNum uint32) error {
+	if _, ok := t.files[fileNum]; ok {
+		return nil
+	}
+	f, err := os.OpenFile(t.dataPath(fileNum), os.O_RDONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if stat, err := f.Stat(); err != nil {
+		return err
+	} else if stat.Size() == 0 {
+		return nil
+	}
+	m, err := mmap.Map(f, mmap.RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	t.files[fileNum] = m
+	return nil
+}
+
+// Retrieve returns the checksummed payload of item, verifying its CRC32.
+func (t *freezerTable) Retrieve(item uint64) ([]byte, error) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	if item >= t.items {
+		return nil, fmt.Errorf("freezer: item %d out of range (have %d) in %q", item, t.items, t.name)
+	}
+	var start indexEntry
+	if item > 0 {
+		buf := make([]byte, indexEntrySize)
+		if _, err := t.index.ReadAt(buf, int64(item-1)*indexEntrySize); err != nil {
+			return nil, err
+		}
+		start = unmarshalIndexEntry(buf)
+	}
+	buf := make([]byte, indexEntrySize)
+	if _, err := t.index.ReadAt(buf, int64(item)*indexEntrySize); err != nil {
+		return nil, err
+	}
+	end := unmarshalIndexEntry(buf)
+
+	// entry(item-1)'s offset is only meaningful within entry(item-1)'s own
+	// file. If item is the first item of end.fileNum (because a rotation
+	// happened between them), it starts at offset 0 of that file, not at
+	// start.offset, which belongs to the previous (now-sealed) file.
+	startOffset := start.offset
+	if start.fileNum != end.fileNum {
+		startOffset = 0
+	}
+
+	var raw []byte
+	if end.fileNum == t.headNum {
+		raw = make([]byte, end.offset-startOffset)
+		if _, err := t.head.ReadAt(raw, int64(startOffset)); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := t.mmapFile(end.fileNum); err != nil {
+			return nil, err
+		}
+		raw = t.files[end.fileNum][startOffset:end.offset]
+	}
+
+	want := binary.BigEndian.Uint32(raw[:recordHeaderSize])
+	payload := raw[recordHeaderSize:]
+	if got := crc32.ChecksumIEEE(payload); got != want {
+		return nil, fmt.Errorf("freezer: checksum mismatch for item %d of %q: want %x, got %x", item, t.name, want, got)
+	}
+	out := make([]byte, len(payload))
+	copy(out, payload)
+	return out, nil
+}
+
+// TruncateHead discards items [items, ...) so that the table holds exactly
+// `items` entries, reopening the head file at the appropriate offset.
+func (t *freezerTable) TruncateHead(items uint64) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if items >= t.items {
+		return nil
+	}
+	if err := t.index.Truncate(int64(items) * indexEntrySize); err != nil {
+		return err
+	}
+	t.items = items
+	// repair() must run first: it recomputes t.headNum from the truncated
+	// index, and that's the number we need to evict stale mmaps against.
+	// Evicting against the pre-truncation t.headNum is a no-op (t.files
+	// only ever holds numbers below the old head), which would leave a
+	// stale read-only mapping in place for any file number truncation
+	// moves the head back into - the next rotate() through that same file
+	// number would then find the cache already populated and skip
+	// remapping, serving pre-truncation bytes against post-truncation
+	// offsets.
+	if err := t.repair(); err != nil {
+		return err
+	}
+	for fileNum, m := range t.files {
+		if fileNum >= t.headNum {
+			_ = m.Unmap()
+			delete(t.files, fileNum)
+		}
+	}
+	return nil
+}
+
+func (t *freezerTable) Items() uint64 {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.items
+}
+
+func (t *freezerTable) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for _, m := range t.files {
+		_ = m.Unmap()
+	}
+	if err := t.head.Close(); err != nil {
+		return err
+	}
+	return t.index.Close()
+}
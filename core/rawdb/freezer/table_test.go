@@ -0,0 +1,102 @@
+package freezer
+
+import "testing"
+
+// TestFreezerTableRetrieveAcrossRotation guards against a regression where
+// Retrieve computed the start offset of an item from the previous item's
+// index entry even when that previous item lived in a different (already
+// sealed) file, underflowing the uint32 subtraction and panicking on the
+// resulting huge slice length.
+func TestFreezerTableRetrieveAcrossRotation(t *testing.T) {
+	dir := t.TempDir()
+
+	// Each item below is 64 bytes (4-byte CRC header + 60-byte payload). A
+	// maxFileSize of 100 forces a rotation before the second item.
+	table, err := newFreezerTable(dir, "test", 100)
+	if err != nil {
+		t.Fatalf("newFreezerTable: %v", err)
+	}
+	defer table.Close()
+
+	items := make([][]byte, 4)
+	for i := range items {
+		data := make([]byte, 60)
+		for j := range data {
+			data[j] = byte(i)
+		}
+		items[i] = data
+		if err := table.Append(uint64(i), data); err != nil {
+			t.Fatalf("Append(%d): %v", i, err)
+		}
+	}
+
+	for i, want := range items {
+		got, err := table.Retrieve(uint64(i))
+		if err != nil {
+			t.Fatalf("Retrieve(%d): %v", i, err)
+		}
+		if string(got) != string(want) {
+			t.Fatalf("Retrieve(%d) = %x, want %x", i, got, want)
+		}
+	}
+}
+
+// TestFreezerTableTruncateHeadEvictsStaleMmap guards against a regression
+// where TruncateHead evicted cached mmaps by comparing against the
+// pre-truncation head number instead of the one repair() recomputes. A file
+// number that gets mmapped, then falls back into head range via
+// TruncateHead, then gets re-sealed by a later rotation, would otherwise
+// keep serving its pre-truncation bytes forever.
+func TestFreezerTableTruncateHeadEvictsStaleMmap(t *testing.T) {
+	dir := t.TempDir()
+
+	table, err := newFreezerTable(dir, "test", 100)
+	if err != nil {
+		t.Fatalf("newFreezerTable: %v", err)
+	}
+	defer table.Close()
+
+	payload := func(b byte) []byte {
+		data := make([]byte, 60)
+		for i := range data {
+			data[i] = b
+		}
+		return data
+	}
+
+	// Items 0, 1, 2 each land in their own file (60-byte payload, 64 bytes
+	// on disk, maxFileSize 100 forces a rotation before every item past the
+	// first). By the time item 2 is appended, file 1 has been sealed and
+	// mmapped.
+	for i, b := range []byte{0x01, 0x02, 0x03} {
+		if err := table.Append(uint64(i), payload(b)); err != nil {
+			t.Fatalf("Append(%d): %v", i, err)
+		}
+	}
+
+	// Truncate back to just item 0: repair() recomputes headNum back to
+	// file 0, and every cached mmap (file 1's, in particular) must be
+	// evicted against that new head, not the old one (2).
+	if err := table.TruncateHead(1); err != nil {
+		t.Fatalf("TruncateHead: %v", err)
+	}
+
+	// Re-append two new items with different content. The first forces a
+	// rotation out of file 0 into file 1 - the same file number that was
+	// mmapped (and should have been evicted) before the truncate. The
+	// second forces file 1 to be sealed and mmapped again.
+	if err := table.Append(1, payload(0xAA)); err != nil {
+		t.Fatalf("Append(1) after truncate: %v", err)
+	}
+	if err := table.Append(2, payload(0xBB)); err != nil {
+		t.Fatalf("Append(2) after truncate: %v", err)
+	}
+
+	got, err := table.Retrieve(1)
+	if err != nil {
+		t.Fatalf("Retrieve(1): %v", err)
+	}
+	if string(got) != string(payload(0xAA)) {
+		t.Fatalf("Retrieve(1) = %x, want %x (stale pre-truncation mmap served instead of fresh data)", got, payload(0xAA))
+	}
+}